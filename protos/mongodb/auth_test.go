@@ -0,0 +1,94 @@
+package mongodb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/elastic/libbeat/common"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestRedactAuthCommandStripsPayloadAndCapturesMechanism(t *testing.T) {
+	document := bson.M{
+		"saslStart": 1,
+		"mechanism": "SCRAM-SHA-256",
+		"payload":   []byte{0x01, 0x02, 0x03},
+	}
+	m := &MongodbMessage{event: common.MapStr{}}
+
+	redactAuthCommand(document, m)
+
+	if m.method != "saslStart" {
+		t.Errorf("m.method = %q, want %q", m.method, "saslStart")
+	}
+	if m.event["mechanism"] != "SCRAM-SHA-256" {
+		t.Errorf(`m.event["mechanism"] = %v, want "SCRAM-SHA-256"`, m.event["mechanism"])
+	}
+	if document["payload"] != redacted {
+		t.Errorf(`document["payload"] = %v, want %q`, document["payload"], redacted)
+	}
+}
+
+// TestRedactAuthCommandRedactsReplyWithoutCommandName verifies a SASL
+// reply - which never repeats the saslStart/saslContinue key, only
+// {conversationId, payload, done, ok} - still gets its payload stripped.
+func TestRedactAuthCommandRedactsReplyWithoutCommandName(t *testing.T) {
+	reply := bson.M{
+		"conversationId": 1,
+		"payload":        []byte{0xca, 0xfe},
+		"done":           false,
+		"ok":             float64(1),
+	}
+	m := &MongodbMessage{event: common.MapStr{}}
+
+	redactAuthCommand(reply, m)
+
+	if reply["payload"] != redacted {
+		t.Errorf(`reply["payload"] = %v, want %q`, reply["payload"], redacted)
+	}
+}
+
+// TestAuthResultReachesTransactionEvent verifies the full path this commit
+// promised end to end: a saslStart/saslContinue exchange, once correlated,
+// carries auth_result and mechanism on the published event, and never the
+// raw payload.
+func TestAuthResultReachesTransactionEvent(t *testing.T) {
+	txns := newTransactions(defaultTransactionTimeout)
+	tuple := common.TcpTuple{}
+
+	query := bson.M{
+		"saslContinue": 1,
+		"payload":      []byte{0xde, 0xad, 0xbe, 0xef},
+	}
+	request := &MongodbMessage{
+		ExpectsResponse: true,
+		requestId:       1,
+		event:           common.MapStr{"mechanism": "SCRAM-SHA-1"},
+	}
+	redactAuthCommand(query, request)
+	queryStr, err := doc2str(query)
+	if err != nil {
+		t.Fatalf("doc2str failed: %v", err)
+	}
+	request.event["query"] = queryStr
+	txns.onMessage(tuple, request, 40)
+
+	replyDoc := bson.M{"ok": float64(0), "code": int32(18)}
+	reply := &MongodbMessage{IsResponse: true, responseTo: 1, event: common.MapStr{}}
+	recordCommandResult(replyDoc, reply)
+
+	event := txns.onMessage(tuple, reply, 40)
+	if event == nil {
+		t.Fatal("expected a merged transaction event")
+	}
+	if event["auth_result"] != "failure" {
+		t.Errorf(`event["auth_result"] = %v, want "failure"`, event["auth_result"])
+	}
+	if event["mechanism"] != "SCRAM-SHA-1" {
+		t.Errorf(`event["mechanism"] = %v, want "SCRAM-SHA-1"`, event["mechanism"])
+	}
+	if !strings.Contains(queryStr, redacted) {
+		t.Errorf("query string was not redacted: %s", queryStr)
+	}
+}
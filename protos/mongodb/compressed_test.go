@@ -0,0 +1,148 @@
+package mongodb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/elastic/libbeat/common"
+)
+
+// buildGetMoreBody returns the OP_GET_MORE message body (everything after
+// the standard header): the reserved int32, a fullCollectionName cstring,
+// numberToReturn, and cursorId. This is what travels as an OP_COMPRESSED
+// payload - opCompressedParse rebuilds the header itself.
+func buildGetMoreBody() []byte {
+	body := []byte{0, 0, 0, 0} // reserved
+	body = append(body, []byte("test.coll")...)
+	body = append(body, 0) // cstring terminator
+	numberToReturn := make([]byte, 4)
+	putInt32(numberToReturn, 2)
+	body = append(body, numberToReturn...)
+	body = append(body, 0, 0, 0, 0, 0, 0, 0, 0) // cursorId = 0
+	return body
+}
+
+// buildCompressedEnvelope wraps payload (already compressed with
+// compressorId) in an OP_COMPRESSED message whose originalOpCode is
+// OP_GET_MORE and whose declared uncompressedSize is uncompressedSize.
+func buildCompressedEnvelope(compressorId byte, payload []byte, uncompressedSize int) []byte {
+	envelope := make([]byte, standardHeaderLength+9+len(payload))
+	putInt32(envelope[0:4], len(envelope))
+	putInt32(envelope[4:8], 0)
+	putInt32(envelope[8:12], 0)
+	putInt32(envelope[12:16], 2012) // OP_COMPRESSED
+	putInt32(envelope[16:20], 2005) // originalOpCode: OP_GET_MORE
+	putInt32(envelope[20:24], uncompressedSize)
+	envelope[24] = compressorId
+	copy(envelope[25:], payload)
+	return envelope
+}
+
+func TestDecompressRoundTrip(t *testing.T) {
+	inner := buildGetMoreBody()
+
+	var zlibBuf bytes.Buffer
+	zw := zlib.NewWriter(&zlibBuf)
+	if _, err := zw.Write(inner); err != nil {
+		t.Fatalf("zlib.Write: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zlib.Close: %v", err)
+	}
+
+	zstdEncoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("zstd.NewWriter: %v", err)
+	}
+	defer zstdEncoder.Close()
+
+	cases := []struct {
+		name         string
+		compressorId byte
+		compressed   []byte
+	}{
+		{"snappy", 1, snappy.Encode(nil, inner)},
+		{"zlib", 2, zlibBuf.Bytes()},
+		{"zstd", 3, zstdEncoder.EncodeAll(inner, nil)},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			decompressed, err := decompress(c.compressorId, c.compressed, len(inner))
+			if err != nil {
+				t.Fatalf("decompress: %v", err)
+			}
+			if !bytes.Equal(decompressed, inner) {
+				t.Fatalf("decompress returned %v, want %v", decompressed, inner)
+			}
+		})
+	}
+}
+
+// TestDecompressRejectsOversizedUncompressedSize reproduces a tiny packet
+// claiming an uncompressedSize that would force a huge allocation before a
+// single byte of it is read.
+func TestDecompressRejectsOversizedUncompressedSize(t *testing.T) {
+	_, err := decompress(1, snappy.Encode(nil, []byte("hi")), maxUncompressedMessageSize+1)
+	if err == nil {
+		t.Fatal("expected an error for an uncompressedSize over the wire message limit")
+	}
+}
+
+// TestDecompressRejectsCompressionBomb reproduces a small, highly
+// compressible zlib payload that claims a small uncompressedSize but
+// actually inflates past it - readLimited must catch this instead of
+// letting ioutil.ReadAll consume it all.
+func TestDecompressRejectsCompressionBomb(t *testing.T) {
+	huge := bytes.Repeat([]byte{0}, 1<<20) // 1MB of zeroes compresses tiny
+
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(huge); err != nil {
+		t.Fatalf("zlib.Write: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zlib.Close: %v", err)
+	}
+
+	// lie about the size: claim far less than the payload actually inflates to
+	_, err := decompress(2, buf.Bytes(), 1024)
+	if err == nil {
+		t.Fatal("expected an error when the decompressed output exceeds the claimed uncompressedSize")
+	}
+}
+
+// TestOpCompressedParsePreservesTrailingData reproduces a pipelined
+// connection: a compressed OP_GET_MORE followed immediately by the start
+// of the next message already sitting in the stream buffer. The trailing
+// bytes must survive in s.data instead of being dropped.
+func TestOpCompressedParsePreservesTrailingData(t *testing.T) {
+	inner := buildGetMoreBody()
+	envelope := buildCompressedEnvelope(0, inner, len(inner)) // compressorId 0: noop
+	trailing := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+
+	s := &MongodbStream{
+		tcptuple: &common.TcpTuple{},
+		data:     append(append([]byte{}, envelope...), trailing...),
+		message:  &MongodbMessage{},
+	}
+
+	ok, complete := mongodbMessageParser(s)
+	if !ok || !complete {
+		t.Fatalf("mongodbMessageParser(s) = (%v, %v), want (true, true)", ok, complete)
+	}
+	if s.message.event["fullCollectionName"] != "test.coll" {
+		t.Fatalf("fullCollectionName = %v, want %q", s.message.event["fullCollectionName"], "test.coll")
+	}
+	if !bytes.HasSuffix(s.data, trailing) {
+		t.Fatalf("s.data lost the trailing bytes of the next message: %v", s.data)
+	}
+	wantLen := standardHeaderLength + len(inner) + len(trailing)
+	if len(s.data) != wantLen {
+		t.Fatalf("s.data length = %d, want %d", len(s.data), wantLen)
+	}
+}
@@ -0,0 +1,88 @@
+package mongodb
+
+import "time"
+
+// Config holds the mongodb protocol settings that are not part of the
+// generic protocol config (ports, send_request, ...) handled by protos.Protocol.
+type Config struct {
+	// Compressors lists the OP_COMPRESSED codecs the sniffer is allowed to
+	// decompress. Leave empty to accept everything the wire protocol
+	// defines (snappy, zlib, zstd).
+	Compressors []string `config:"compressors"`
+
+	// TransactionTimeout is how long a request is kept waiting for its
+	// matching reply before it is dropped, in case the reply never shows
+	// up (dropped packet, killed cursor, ...). 0 means the 30s default.
+	TransactionTimeout time.Duration `config:"transaction_timeout"`
+
+	// MaxDocSize is the maximum size, in bytes, of a BSON document kept in
+	// an event. A larger document (selector, update, query, results, ...)
+	// is replaced as a whole by a {"...": "<truncated N bytes>"} placeholder,
+	// N being the number of bytes over the limit; none of its content is
+	// kept. 0 means the default of 10000 bytes.
+	MaxDocSize int `config:"max_doc_size"`
+
+	// MaxDocs is the maximum number of documents read out of an OP_REPLY.
+	// Cursors returning more than this are marked as truncated. 0 means the
+	// default of 10000 documents.
+	MaxDocs int `config:"max_docs"`
+}
+
+const (
+	defaultMaxDocSize = 10000
+	defaultMaxDocs    = 10000
+)
+
+// maxDocSize and maxDocs mirror Config.MaxDocSize/MaxDocs; the parser reads
+// them as package vars since it only ever sees raw bytes, not the Config.
+var (
+	maxDocSize = defaultMaxDocSize
+	maxDocs    = defaultMaxDocs
+)
+
+var defaultCompressors = []string{"snappy", "zlib", "zstd"}
+
+// compressors are the codecs OP_COMPRESSED is allowed to decompress.
+// Populated from Config.Compressors when the protocol is configured,
+// defaulting to every codec the wire protocol defines.
+var compressors = defaultCompressors
+
+func compressorEnabled(name string) bool {
+	for _, c := range compressors {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Configure applies cfg to the package-level settings the parser and the
+// transaction correlator actually read (compressors, maxDocSize, maxDocs,
+// txns' timeout). It is called once, from Init, when the protocol is set
+// up from the beats configuration file; a zero-value Config field falls
+// back to its documented default rather than disabling the feature.
+func Configure(cfg Config) {
+	if len(cfg.Compressors) > 0 {
+		compressors = cfg.Compressors
+	} else {
+		compressors = defaultCompressors
+	}
+
+	if cfg.MaxDocSize > 0 {
+		maxDocSize = cfg.MaxDocSize
+	} else {
+		maxDocSize = defaultMaxDocSize
+	}
+
+	if cfg.MaxDocs > 0 {
+		maxDocs = cfg.MaxDocs
+	} else {
+		maxDocs = defaultMaxDocs
+	}
+
+	timeout := cfg.TransactionTimeout
+	if timeout == 0 {
+		timeout = defaultTransactionTimeout
+	}
+	txns = newTransactions(timeout)
+}
@@ -0,0 +1,52 @@
+package mongodb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigureAppliesSettings(t *testing.T) {
+	defer Configure(Config{}) // restore defaults for other tests
+
+	Configure(Config{
+		Compressors:        []string{"zlib"},
+		TransactionTimeout: 5 * time.Second,
+		MaxDocSize:         123,
+		MaxDocs:            7,
+	})
+
+	if maxDocSize != 123 {
+		t.Errorf("maxDocSize = %d, want 123", maxDocSize)
+	}
+	if maxDocs != 7 {
+		t.Errorf("maxDocs = %d, want 7", maxDocs)
+	}
+	if !compressorEnabled("zlib") {
+		t.Error("zlib should be enabled")
+	}
+	if compressorEnabled("snappy") {
+		t.Error("snappy should not be enabled, only zlib was configured")
+	}
+	if txns.timeout != 5*time.Second {
+		t.Errorf("txns.timeout = %v, want 5s", txns.timeout)
+	}
+}
+
+func TestConfigureFallsBackToDefaults(t *testing.T) {
+	defer Configure(Config{})
+
+	Configure(Config{})
+
+	if maxDocSize != defaultMaxDocSize {
+		t.Errorf("maxDocSize = %d, want default %d", maxDocSize, defaultMaxDocSize)
+	}
+	if maxDocs != defaultMaxDocs {
+		t.Errorf("maxDocs = %d, want default %d", maxDocs, defaultMaxDocs)
+	}
+	if !compressorEnabled("snappy") || !compressorEnabled("zlib") || !compressorEnabled("zstd") {
+		t.Error("all compressors should be enabled by default")
+	}
+	if txns.timeout != defaultTransactionTimeout {
+		t.Errorf("txns.timeout = %v, want default %v", txns.timeout, defaultTransactionTimeout)
+	}
+}
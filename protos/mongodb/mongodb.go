@@ -0,0 +1,67 @@
+package mongodb
+
+import (
+	"github.com/elastic/libbeat/common"
+)
+
+// MongodbMessage is a single parsed wire-protocol message: a command, a
+// reply, or the result of unwrapping an OP_MSG/OP_COMPRESSED envelope.
+type MongodbMessage struct {
+	IsResponse      bool
+	ExpectsResponse bool
+
+	requestId     int
+	responseTo    int
+	messageLength int
+	opCode        string
+
+	// moreToCome mirrors the OP_MSG moreToCome flag bit: the sender isn't
+	// waiting on a reply to this message and will push another one later
+	// without being asked, as exhaust cursors do. Recorded regardless of
+	// IsResponse/ExpectsResponse so the correlator can tell an exhaust
+	// continuation (responseTo == 0, no peer ever asked for a response)
+	// apart from an actual new request.
+	moreToCome bool
+
+	method string
+	error  string
+	event  common.MapStr
+}
+
+// MongodbStream carries the reassembled bytes of one direction of a TCP
+// connection together with the message currently being parsed out of it.
+type MongodbStream struct {
+	tcptuple *common.TcpTuple
+	data     []byte
+	message  *MongodbMessage
+}
+
+// OpCodes maps a wire protocol opcode to its name. mongodb_parser.go's
+// init() adds OP_COMPRESSED (2012) and OP_MSG_2013 (2013) to this map.
+var OpCodes = map[int]string{
+	1:    "OP_REPLY",
+	1000: "OP_MSG",
+	2001: "OP_UPDATE",
+	2002: "OP_INSERT",
+	2004: "OP_QUERY",
+	2005: "OP_GET_MORE",
+	2006: "OP_DELETE",
+	2007: "OP_KILL_CURSORS",
+}
+
+// UserCommands are the database commands opQueryParse/opMsgParse2013 look
+// for in a $cmd query, to label m.method with something more specific than
+// "otherCommand".
+var UserCommands = []string{
+	"ismaster", "count", "distinct", "group", "mapreduce", "findandmodify",
+	"geonear", "getlasterror", "aggregate", "insert", "update", "delete",
+	"find", "getMore", "killCursors",
+}
+
+// Init applies cfg to the parser and transaction correlator. The protocol
+// registration calls this once at startup with the mongodb section of the
+// beats configuration file, the same way the other protocols push their
+// own config into their package state.
+func Init(cfg Config) {
+	Configure(cfg)
+}
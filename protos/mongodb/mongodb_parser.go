@@ -1,17 +1,45 @@
 package mongodb
 
 import (
+	"bytes"
+	"compress/zlib"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"strings"
 
 	"github.com/elastic/libbeat/common"
 	"github.com/elastic/libbeat/logp"
 
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+
 	"labix.org/v2/mgo/bson"
 )
 
+func init() {
+	// Modern drivers (MongoDB >= 3.6) send every command through OP_MSG
+	// instead of the legacy OP_QUERY/OP_REPLY pair, and MongoDB >= 6.0 no
+	// longer accepts anything else.
+	OpCodes[2013] = "OP_MSG_2013"
+	// Drivers negotiating wire compression wrap everything above in an
+	// OP_COMPRESSED envelope.
+	OpCodes[2012] = "OP_COMPRESSED"
+}
+
+// maxCompressionDepth bounds how many OP_COMPRESSED envelopes may be
+// nested inside one another. compressorId 0 is a documented no-op, so
+// without a limit a handful of trivial envelopes could drive this
+// recursion deep enough to exhaust the goroutine's stack.
+const maxCompressionDepth = 16
+
 func mongodbMessageParser(s *MongodbStream) (bool, bool) {
+	return parseMongodbMessage(s, 0)
+}
+
+func parseMongodbMessage(s *MongodbStream, compressionDepth int) (bool, bool) {
 	d := newDecoder(s.data)
 
 	length, err := d.readInt32()
@@ -48,35 +76,73 @@ func mongodbMessageParser(s *MongodbStream) (bool, bool) {
 	// then split depending on operation type
 	s.message.event = common.MapStr{}
 
+	// OP_COMPRESSED unwraps to another message and recurses into
+	// parseMongodbMessage itself, which already runs the transaction
+	// correlation below for the unwrapped message; returning straight
+	// away here avoids correlating the same message twice.
+	if s.message.opCode == "OP_COMPRESSED" {
+		if compressionDepth >= maxCompressionDepth {
+			logp.Err("OP_COMPRESSED envelopes nested more than %d deep, dropping", maxCompressionDepth)
+			return false, false
+		}
+		return opCompressedParse(d, s, length, compressionDepth)
+	}
+
+	var ok, complete bool
+
 	switch s.message.opCode {
 	case "OP_REPLY":
 		s.message.IsResponse = true
-		return opReplyParse(d, s.message)
+		ok, complete = opReplyParse(d, s.message)
 	case "OP_MSG":
 		s.message.method = "msg"
-		return opMsgParse(d, s.message)
+		ok, complete = opMsgParse(d, s.message)
+	case "OP_MSG_2013":
+		// OP_MSG (2013) carries both requests and replies over the same
+		// opcode, so request/response can only be told apart by looking
+		// at responseTo: a reply always echoes the requestId it answers.
+		s.message.IsResponse = s.message.responseTo != 0
+		s.message.ExpectsResponse = !s.message.IsResponse
+		ok, complete = opMsgParse2013(d, s.message)
 	case "OP_UPDATE":
 		s.message.method = "update"
-		return opUpdateParse(d, s.message)
+		ok, complete = opUpdateParse(d, s.message)
 	case "OP_INSERT":
 		s.message.method = "insert"
-		return opInsertParse(d, s.message)
+		ok, complete = opInsertParse(d, s.message)
 	case "OP_QUERY":
 		s.message.ExpectsResponse = true
-		return opQueryParse(d, s.message)
+		ok, complete = opQueryParse(d, s.message)
 	case "OP_GET_MORE":
 		s.message.method = "getMore"
 		s.message.ExpectsResponse = true
-		return opGetMoreParse(d, s.message)
+		ok, complete = opGetMoreParse(d, s.message)
 	case "OP_DELETE":
 		s.message.method = "delete"
-		return opDeleteParse(d, s.message)
+		ok, complete = opDeleteParse(d, s.message)
 	case "OP_KILL_CURSORS":
 		s.message.method = "killCursors"
-		return opKillCursorsParse(d, s.message)
+		ok, complete = opKillCursorsParse(d, s.message)
+	default:
+		return false, false
+	}
+
+	if ok && complete {
+		correlateTransaction(s)
 	}
 
-	return false, false
+	return ok, complete
+}
+
+// correlateTransaction feeds a fully parsed message through the
+// request/reply correlator and, once a pair completes, attaches the
+// merged transaction event so it travels alongside the message to
+// publishing.
+func correlateTransaction(s *MongodbStream) {
+	event := txns.onMessage(*s.tcptuple, s.message, len(s.data))
+	if event != nil {
+		s.message.event["transaction"] = event
+	}
 }
 
 // see http://docs.mongodb.org/meta-driver/latest/legacy/mongodb-wire-protocol/#op-reply
@@ -90,8 +156,14 @@ func opReplyParse(d *decoder, m *MongodbMessage) (bool, bool) {
 
 	logp.Debug("mongodb", "Prepare to read %i document from reply", m.event["numberReturned"])
 
-	documents := make([]string, numberReturned)
-	for i := 0; i < numberReturned; i++ {
+	limit := numberReturned
+	if maxDocs > 0 && limit > maxDocs {
+		limit = maxDocs
+		m.event["truncated"] = true
+	}
+
+	documents := make([]string, limit)
+	for i := 0; i < limit; i++ {
 		var document bson.M
 		document, err = d.readDocument()
 
@@ -100,7 +172,9 @@ func opReplyParse(d *decoder, m *MongodbMessage) (bool, bool) {
 			if mongoError, present := document["$err"]; present {
 				m.error, err = doc2str(mongoError)
 			}
+			recordCommandResult(document, m)
 		}
+		redactAuthCommand(document, m)
 
 		documents[i], err = doc2str(document)
 	}
@@ -123,6 +197,243 @@ func opMsgParse(d *decoder, m *MongodbMessage) (bool, bool) {
 	return true, true
 }
 
+// see https://github.com/mongodb/specifications/blob/master/source/message/OP_MSG.rst
+func opMsgParse2013(d *decoder, m *MongodbMessage) (bool, bool) {
+	flagBits, err := d.readInt32()
+	if err != nil {
+		logp.Err("An error occured while parsing OP_MSG message: %s", err)
+		return false, false
+	}
+
+	checksumPresent := flagBits&0x1 != 0
+	moreToCome := flagBits&0x2 != 0
+
+	end := len(d.in)
+	if checksumPresent {
+		// trailing CRC32C, not part of the sections
+		end -= 4
+	}
+
+	m.method = "otherCommand"
+
+	for d.i < end {
+		kind, err := d.readByte()
+		if err != nil {
+			logp.Err("An error occured while parsing OP_MSG message: %s", err)
+			return false, false
+		}
+
+		switch kind {
+		case 0:
+			// Body: a single BSON document, the command itself
+			var document bson.M
+			document, err = d.readDocument()
+			if err != nil {
+				logp.Err("An error occured while parsing OP_MSG message: %s", err)
+				return false, false
+			}
+
+			for _, command := range UserCommands {
+				if _, present := document[command]; present {
+					m.method = command
+				}
+			}
+			redactAuthCommand(document, m)
+
+			if m.IsResponse {
+				recordCommandResult(document, m)
+			} else {
+				// OP_MSG carries $db instead of a "db.collection" string,
+				// and the command's own key usually names the collection
+				// (e.g. {"find": "coll", "$db": "test"}); rebuild the
+				// fullCollectionName the legacy opcodes populated directly.
+				m.event["fullCollectionName"] = fullCollectionName(document, m.method)
+			}
+
+			m.event["query"], err = doc2str(document)
+			if err != nil {
+				logp.Err("An error occured while parsing OP_MSG message: %s", err)
+				return false, false
+			}
+		case 1:
+			// Document sequence: size int32, cstring identifier, then
+			// as many BSON documents as fit in size.
+			sectionStart := d.i
+			size, err := d.readInt32()
+			if err != nil {
+				logp.Err("An error occured while parsing OP_MSG message: %s", err)
+				return false, false
+			}
+			identifier, err := d.readCStr()
+			if err != nil {
+				logp.Err("An error occured while parsing OP_MSG message: %s", err)
+				return false, false
+			}
+
+			documents := []string{}
+			for d.i < sectionStart+size {
+				var document bson.M
+				document, err = d.readDocument()
+				if err != nil {
+					logp.Err("An error occured while parsing OP_MSG message: %s", err)
+					return false, false
+				}
+
+				var str string
+				str, err = doc2str(document)
+				if err != nil {
+					logp.Err("An error occured while parsing OP_MSG message: %s", err)
+					return false, false
+				}
+				documents = append(documents, str)
+			}
+			m.event[identifier] = documents
+		default:
+			logp.Err("Unknown OP_MSG section kind: %d", kind)
+			return false, false
+		}
+	}
+
+	m.moreToCome = moreToCome
+	if moreToCome {
+		// no reply is sent for this message, so it can't be correlated
+		// to a response and shouldn't block waiting for one
+		m.ExpectsResponse = false
+	}
+
+	return true, true
+}
+
+// fullCollectionName rebuilds the "db.collection" string OP_QUERY/OP_GET_MORE
+// send directly on the wire, from the $db and command-name fields an OP_MSG
+// body carries instead. Commands that don't target a collection (e.g.
+// {"ismaster": 1}) leave the collection half empty.
+func fullCollectionName(document bson.M, method string) string {
+	db, _ := document["$db"].(string)
+	if db == "" {
+		return ""
+	}
+	if collection, ok := document[method].(string); ok {
+		return db + "." + collection
+	}
+	return db
+}
+
+const standardHeaderLength = 16
+
+// see https://github.com/mongodb/specifications/blob/master/source/compression/OP_COMPRESSED.rst
+//
+// OP_COMPRESSED wraps any other message in a compression envelope. We
+// decompress it and feed the result back through parseMongodbMessage as
+// if it had been the message actually on the wire, reusing the outer
+// requestId/responseTo to rebuild a standard header.
+func opCompressedParse(d *decoder, s *MongodbStream, length int, compressionDepth int) (bool, bool) {
+	originalOpCode, err := d.readInt32()
+	if err != nil {
+		logp.Err("An error occured while parsing OP_COMPRESSED message: %s", err)
+		return false, false
+	}
+	uncompressedSize, err := d.readInt32()
+	if err != nil {
+		logp.Err("An error occured while parsing OP_COMPRESSED message: %s", err)
+		return false, false
+	}
+	compressorId, err := d.readByte()
+	if err != nil {
+		logp.Err("An error occured while parsing OP_COMPRESSED message: %s", err)
+		return false, false
+	}
+
+	payload, err := decompress(compressorId, d.in[d.i:], uncompressedSize)
+	if err != nil {
+		logp.Err("An error occured while decompressing OP_COMPRESSED message: %s", err)
+		return false, false
+	}
+
+	message := make([]byte, standardHeaderLength+len(payload))
+	putInt32(message[0:4], len(message))
+	putInt32(message[4:8], s.message.requestId)
+	putInt32(message[8:12], s.message.responseTo)
+	putInt32(message[12:16], originalOpCode)
+	copy(message[standardHeaderLength:], payload)
+
+	// s.data may already hold the start of the next pipelined message
+	// past the end of this OP_COMPRESSED envelope (length, not the
+	// decompressed size); keep it instead of dropping it on the floor.
+	s.data = append(message, s.data[length:]...)
+	return parseMongodbMessage(s, compressionDepth+1)
+}
+
+// maxUncompressedMessageSize bounds how large a single OP_COMPRESSED
+// envelope is allowed to inflate to: MongoDB's own wire protocol caps
+// every message, compressed or not, at 48MB. uncompressedSize is read
+// straight off the wire, so without this check a single small packet
+// claiming an enormous size can force a multi-gigabyte allocation, and
+// a small, highly-compressible zlib/zstd payload is a classic
+// compression bomb without a limit on the inflated output.
+const maxUncompressedMessageSize = 48 * 1024 * 1024
+
+func decompress(compressorId byte, data []byte, uncompressedSize int) ([]byte, error) {
+	if uncompressedSize < 0 || uncompressedSize > maxUncompressedMessageSize {
+		return nil, fmt.Errorf("OP_COMPRESSED uncompressedSize %d exceeds the %d byte wire message limit", uncompressedSize, maxUncompressedMessageSize)
+	}
+
+	switch compressorId {
+	case 0:
+		// noop, payload is sent uncompressed
+		return data, nil
+	case 1:
+		if !compressorEnabled("snappy") {
+			return nil, errors.New("snappy compressor is not enabled")
+		}
+		return snappy.Decode(make([]byte, uncompressedSize), data)
+	case 2:
+		if !compressorEnabled("zlib") {
+			return nil, errors.New("zlib compressor is not enabled")
+		}
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readLimited(r, uncompressedSize)
+	case 3:
+		if !compressorEnabled("zstd") {
+			return nil, errors.New("zstd compressor is not enabled")
+		}
+		r, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readLimited(r, uncompressedSize)
+	default:
+		return nil, errors.New("unsupported OP_COMPRESSED compressor id")
+	}
+}
+
+// readLimited reads r fully, but stops and errors out as soon as more than
+// limit bytes have come out of it, instead of trusting the stream to end
+// on its own. A zlib/zstd reader will happily keep inflating a small,
+// highly-compressible payload far past any size it honestly claimed.
+func readLimited(r io.Reader, limit int) ([]byte, error) {
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, fmt.Errorf("decompressed OP_COMPRESSED payload exceeds the %d byte wire message limit", limit)
+	}
+	return out, nil
+}
+
+func putInt32(b []byte, v int) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+	b[3] = byte(v >> 24)
+}
+
 func opUpdateParse(d *decoder, m *MongodbMessage) (bool, bool) {
 	_, err := d.readInt32() // always ZERO, a slot reserved in the protocol for future use
 	m.event["fullCollectionName"], err = d.readCStr()
@@ -176,6 +487,7 @@ func opQueryParse(d *decoder, m *MongodbMessage) (bool, bool) {
 				m.method = command
 			}
 		}
+		redactAuthCommand(query, m)
 	} else {
 		m.method = "find"
 	}
@@ -255,6 +567,16 @@ func (d *decoder) readCStr() (string, error) {
 	return string(d.in[start:end]), nil
 }
 
+func (d *decoder) readByte() (byte, error) {
+	b, err := d.readBytes(1)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return b[0], nil
+}
+
 func (d *decoder) readInt32() (int, error) {
 	b, err := d.readBytes(4)
 
@@ -285,11 +607,34 @@ func (d *decoder) readInt64() (int, error) {
 		(uint64(b[7]) << 56)), nil
 }
 
+// minDocumentLength is the smallest a valid BSON document can be: an int32
+// length plus the terminating 0x00 byte.
+const minDocumentLength = 5
+
 func (d *decoder) readDocument() (bson.M, error) {
 	start := d.i
 	documentLength, err := d.readInt32()
+	if err != nil {
+		return nil, err
+	}
+
+	// A malformed or truncated capture can claim a length that doesn't
+	// move the cursor forward (e.g. 0), which would make callers that
+	// loop on d.i spin forever re-reading the same bytes. Reject it
+	// instead of trusting it as a read cursor.
+	if documentLength < minDocumentLength || start+documentLength > len(d.in) {
+		return nil, errors.New("invalid BSON document length")
+	}
 	d.i = start + documentLength
 
+	// Don't even unmarshal documents over max_doc_size: a multi-MB
+	// aggregation result shouldn't blow up the sniffer's memory just to
+	// be truncated afterwards.
+	if maxDocSize > 0 && documentLength > maxDocSize {
+		logp.Debug("mongodb", "Replacing %d bytes document over the %d bytes limit with a placeholder", documentLength, maxDocSize)
+		return bson.M{"...": fmt.Sprintf("<truncated %d bytes>", documentLength-maxDocSize)}, nil
+	}
+
 	documentMap := bson.M{}
 
 	logp.Debug("mongodb", "Parse %d bytes document from remaining %d bytes", documentLength, len(d.in)-start)
@@ -303,9 +648,87 @@ func (d *decoder) readDocument() (bson.M, error) {
 	return documentMap, err
 }
 
+// authCommands are the commands used to negotiate or manage authentication.
+// Their payload carries nonces and (hashed) passwords that have no business
+// being stored verbatim in an event.
+var authCommands = []string{
+	"saslStart", "saslContinue", "authenticate", "copydbSaslStart",
+	"createUser", "updateUser",
+}
+
+const redacted = "REDACTED"
+
+// redactAuthCommand recognizes the SASL/authentication commands, records
+// the negotiated mechanism on the event and strips the binary payload/pwd
+// fields from document in place so they never reach doc2str.
+//
+// saslStart/saslContinue replies never repeat the command name - they look
+// like {conversationId, payload, done, ok} - so payload/pwd are redacted
+// unconditionally whenever present, not just when a known auth command key
+// was found alongside them.
+func redactAuthCommand(document bson.M, m *MongodbMessage) {
+	for _, command := range authCommands {
+		if _, present := document[command]; present {
+			m.method = command
+		}
+	}
+
+	if mechanism, present := document["mechanism"]; present {
+		if str, ok := mechanism.(string); ok {
+			m.event["mechanism"] = str
+		}
+	}
+
+	if _, present := document["payload"]; present {
+		document["payload"] = redacted
+	}
+	if _, present := document["pwd"]; present {
+		document["pwd"] = redacted
+	}
+}
+
+// recordCommandResult extracts the ok/code/errmsg fields MongoDB puts on
+// every command reply so the transaction correlator can report auth_result
+// without having to re-parse the documents array. errmsg also becomes
+// m.error, the same field the legacy OP_REPLY $err convention populates,
+// so a failed OP_MSG command surfaces a human-readable error too and not
+// just a numeric code.
+func recordCommandResult(document bson.M, m *MongodbMessage) {
+	if ok, present := document["ok"]; present {
+		m.event["ok"] = ok
+	}
+	if code, present := document["code"]; present {
+		m.event["code"] = code
+	}
+	if errmsg, present := document["errmsg"]; present {
+		if str, ok := errmsg.(string); ok {
+			m.event["errmsg"] = str
+			m.error = str
+		}
+	}
+}
+
 func doc2str(documentMap interface{}) (string, error) {
 	document, err := json.Marshal(documentMap)
-	return string(document), err
+	if err != nil {
+		return "", err
+	}
+
+	if maxDocSize > 0 && len(document) > maxDocSize {
+		// A raw byte cut here would routinely land mid-UTF8-rune or
+		// inside a quoted string value and produce invalid JSON, so
+		// replace the whole value with a small placeholder document
+		// instead of slicing the marshaled bytes.
+		placeholder, err := json.Marshal(common.MapStr{
+			"...": fmt.Sprintf("<truncated %d bytes>", len(document)-maxDocSize),
+		})
+		if err != nil {
+			return "", err
+		}
+		return string(placeholder), nil
+	}
+
+	return string(document), nil
 }
 
 func (d *decoder) readDocumentStr() (string, error) {
@@ -0,0 +1,103 @@
+package mongodb
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/libbeat/common"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestReadDocumentRejectsZeroLength(t *testing.T) {
+	// documentLength = 0 would otherwise reset d.i back to where it
+	// started, making any caller that loops on d.i spin forever.
+	d := newDecoder([]byte{0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff})
+
+	_, err := d.readDocument()
+	if err == nil {
+		t.Fatal("expected an error for a zero-length document, got nil")
+	}
+	if d.i == 0 {
+		t.Fatal("decoder cursor did not advance past the length field on error")
+	}
+}
+
+func TestReadDocumentRejectsLengthPastEndOfBuffer(t *testing.T) {
+	d := newDecoder([]byte{0x7f, 0x00, 0x00, 0x00, 0x00})
+
+	if _, err := d.readDocument(); err == nil {
+		t.Fatal("expected an error for a document length larger than the remaining bytes, got nil")
+	}
+}
+
+func TestOpMsgParse2013RejectsZeroLengthDocumentInSequence(t *testing.T) {
+	data := []byte{
+		0x00, 0x00, 0x00, 0x00, // flagBits
+		0x01,                   // kind 1 (document sequence)
+		0x0b, 0x00, 0x00, 0x00, // section size = 11
+		'd', 0x00, // identifier "d"
+		0x00, 0x00, 0x00, 0x00, // documentLength = 0 (malformed)
+	}
+	d := newDecoder(data)
+	m := &MongodbMessage{event: common.MapStr{}}
+
+	done := make(chan struct{})
+	go func() {
+		opMsgParse2013(d, m)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("opMsgParse2013 hung on a malformed document-sequence section")
+	}
+}
+
+func TestOpMsgParse2013PopulatesFullCollectionNameFromDb(t *testing.T) {
+	document, err := bson.Marshal(bson.M{"find": "test", "$db": "mydb"})
+	if err != nil {
+		t.Fatalf("bson.Marshal: %v", err)
+	}
+
+	body := []byte{0, 0, 0, 0} // flagBits
+	body = append(body, 0)     // kind 0 (body section)
+	body = append(body, document...)
+
+	d := newDecoder(body)
+	m := &MongodbMessage{event: common.MapStr{}}
+
+	ok, complete := opMsgParse2013(d, m)
+	if !ok || !complete {
+		t.Fatalf("opMsgParse2013(d, m) = (%v, %v), want (true, true)", ok, complete)
+	}
+	if m.event["fullCollectionName"] != "mydb.test" {
+		t.Errorf(`m.event["fullCollectionName"] = %v, want "mydb.test"`, m.event["fullCollectionName"])
+	}
+}
+
+func TestDoc2strTruncatesToValidJSON(t *testing.T) {
+	old := maxDocSize
+	maxDocSize = 16
+	defer func() { maxDocSize = old }()
+
+	// A value that contains a multi-byte rune right at the naive cut
+	// point used to produce invalid UTF-8/JSON when sliced raw.
+	big := map[string]string{"k": strings.Repeat("é", 50)}
+
+	str, err := doc2str(big)
+	if err != nil {
+		t.Fatalf("doc2str returned an error: %v", err)
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(str), &parsed); err != nil {
+		t.Fatalf("truncated output is not valid JSON: %v (output: %q)", err, str)
+	}
+	if _, present := parsed["..."]; !present {
+		t.Fatalf("expected a truncation marker, got %q", str)
+	}
+}
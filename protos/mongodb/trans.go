@@ -0,0 +1,186 @@
+package mongodb
+
+import (
+	"time"
+
+	"github.com/elastic/libbeat/common"
+	"github.com/elastic/libbeat/logp"
+)
+
+const defaultTransactionTimeout = 30 * time.Second
+
+// txns is the correlator every parsed message goes through; Configure
+// replaces it once the protocol's transaction_timeout setting is known.
+var txns = newTransactions(defaultTransactionTimeout)
+
+// transactionKey identifies a request/reply pair: the TCP stream plus the
+// requestId the driver picked for its request. A reply always carries that
+// same id back in responseTo.
+type transactionKey struct {
+	tuple     common.HashableTcpTuple
+	requestId int
+}
+
+// transaction holds the request half of an in-flight command while the
+// matching reply is awaited.
+type transaction struct {
+	ts       time.Time
+	request  *MongodbMessage
+	bytesOut int
+}
+
+// transactions correlates MongoDB requests with their replies and emits a
+// single merged event per command, the same way the http and mysql
+// protocols already do.
+type transactions struct {
+	timeout time.Duration
+	pending map[transactionKey]*transaction
+
+	// exhaustCursors marks TCP streams currently mid an OP_MSG exhaust
+	// cursor: the server keeps pushing messages with responseTo == 0
+	// that no client request ever asked for, until the final one clears
+	// moreToCome. Without this, the last such message - the only one
+	// that doesn't carry moreToCome itself - looks exactly like a fresh
+	// request and leaks into pending forever. The timestamp lets expire()
+	// reclaim a tuple whose stream dropped mid-exhaust and never sent
+	// that final continuation at all.
+	exhaustCursors map[common.HashableTcpTuple]time.Time
+}
+
+func newTransactions(timeout time.Duration) *transactions {
+	if timeout == 0 {
+		timeout = defaultTransactionTimeout
+	}
+	return &transactions{
+		timeout:        timeout,
+		pending:        make(map[transactionKey]*transaction),
+		exhaustCursors: make(map[common.HashableTcpTuple]time.Time),
+	}
+}
+
+// onMessage records m if it is a request awaiting a reply, or, if m is the
+// reply to a previously seen request, returns the merged transaction event
+// ready for publishing. It returns nil when there is nothing to publish yet.
+func (t *transactions) onMessage(tuple common.TcpTuple, m *MongodbMessage, bytes int) common.MapStr {
+	t.expire()
+
+	hashable := tuple.Hashable()
+
+	if _, active := t.exhaustCursors[hashable]; m.responseTo == 0 && active {
+		// An exhaust continuation: server-pushed, no client request
+		// behind it, identifiable only by following a reply that had
+		// moreToCome set. Once a continuation itself drops moreToCome
+		// the stream is done.
+		if !m.moreToCome {
+			delete(t.exhaustCursors, hashable)
+		} else {
+			t.exhaustCursors[hashable] = time.Now()
+		}
+		return nil
+	}
+
+	if m.ExpectsResponse {
+		t.pending[transactionKey{hashable, m.requestId}] = &transaction{
+			ts:       time.Now(),
+			request:  m,
+			bytesOut: bytes,
+		}
+		return nil
+	}
+
+	if !m.IsResponse {
+		// one-way message (e.g. an OP_MSG with moreToCome set), there is
+		// no reply to correlate it with
+		return nil
+	}
+
+	key := transactionKey{hashable, m.responseTo}
+	req, found := t.pending[key]
+	if !found {
+		logp.Debug("mongodb", "Response for unknown requestId=%d, ignoring", m.responseTo)
+		return nil
+	}
+	delete(t.pending, key)
+
+	event := common.MapStr{
+		"method":             req.request.method,
+		"fullCollectionName": req.request.event["fullCollectionName"],
+		"query":              req.request.event["query"],
+		"numberReturned":     m.event["numberReturned"],
+		"cursorId":           m.event["cursorId"],
+		"responseTime":       int32(time.Since(req.ts).Nanoseconds() / int64(time.Millisecond)),
+		"bytes_in":           req.bytesOut,
+		"bytes_out":          bytes,
+	}
+	if m.error != "" {
+		event["error"] = m.error
+	}
+	if isAuthCommand(req.request.method) {
+		event["auth_result"] = authResult(m)
+		if mechanism, present := req.request.event["mechanism"]; present {
+			event["mechanism"] = mechanism
+		}
+	}
+	if m.moreToCome {
+		// this reply is the first message of an exhaust cursor; the
+		// continuations that follow carry responseTo == 0 and must not
+		// be mistaken for new requests
+		t.exhaustCursors[hashable] = time.Now()
+	}
+	return event
+}
+
+func isAuthCommand(method string) bool {
+	for _, command := range authCommands {
+		if command == method {
+			return true
+		}
+	}
+	return false
+}
+
+// authResult turns the ok field recorded off the reply's command document
+// into the same "success"/"failure" vocabulary security dashboards already
+// expect from other beats protocols; the code field is not consulted. A
+// reply without ok gives "unknown".
+func authResult(reply *MongodbMessage) string {
+	ok, present := reply.event["ok"]
+	if !present {
+		return "unknown"
+	}
+
+	switch v := ok.(type) {
+	case float64:
+		if v == 1 {
+			return "success"
+		}
+	case int:
+		if v == 1 {
+			return "success"
+		}
+	case bool:
+		if v {
+			return "success"
+		}
+	}
+	return "failure"
+}
+
+// expire drops pending requests whose reply never showed up within
+// timeout, so exhausted or killed cursors don't leak memory forever. It
+// also reclaims exhaustCursors entries whose stream went quiet mid-exhaust
+// (packet loss, client disconnect) and never sent the final continuation
+// that would otherwise have cleared the marker.
+func (t *transactions) expire() {
+	now := time.Now()
+	for key, txn := range t.pending {
+		if now.Sub(txn.ts) > t.timeout {
+			delete(t.pending, key)
+		}
+	}
+	for key, ts := range t.exhaustCursors {
+		if now.Sub(ts) > t.timeout {
+			delete(t.exhaustCursors, key)
+		}
+	}
+}
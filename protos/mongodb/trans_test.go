@@ -0,0 +1,202 @@
+package mongodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elastic/libbeat/common"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestTransactionsCorrelatesRequestAndReply(t *testing.T) {
+	txns := newTransactions(defaultTransactionTimeout)
+	tuple := common.TcpTuple{}
+
+	request := &MongodbMessage{
+		ExpectsResponse: true,
+		requestId:       42,
+		method:          "find",
+		event:           common.MapStr{"fullCollectionName": "test.$cmd", "query": `{"find":"test"}`},
+	}
+	if event := txns.onMessage(tuple, request, 50); event != nil {
+		t.Fatalf("expected no event yet for a lone request, got %v", event)
+	}
+
+	reply := &MongodbMessage{
+		IsResponse: true,
+		responseTo: 42,
+		event:      common.MapStr{"numberReturned": 3, "cursorId": 0},
+	}
+	event := txns.onMessage(tuple, reply, 200)
+	if event == nil {
+		t.Fatal("expected a merged transaction event once the reply arrives")
+	}
+	if event["method"] != "find" {
+		t.Errorf(`event["method"] = %v, want "find"`, event["method"])
+	}
+	if event["numberReturned"] != 3 {
+		t.Errorf(`event["numberReturned"] = %v, want 3`, event["numberReturned"])
+	}
+	if event["bytes_in"] != 50 || event["bytes_out"] != 200 {
+		t.Errorf("event bytes_in/bytes_out = %v/%v, want 50/200", event["bytes_in"], event["bytes_out"])
+	}
+}
+
+func TestTransactionsEmitsAuthResult(t *testing.T) {
+	txns := newTransactions(defaultTransactionTimeout)
+	tuple := common.TcpTuple{}
+
+	request := &MongodbMessage{
+		ExpectsResponse: true,
+		requestId:       7,
+		method:          "saslStart",
+		event:           common.MapStr{"mechanism": "SCRAM-SHA-256"},
+	}
+	txns.onMessage(tuple, request, 10)
+
+	reply := &MongodbMessage{
+		IsResponse: true,
+		responseTo: 7,
+		event:      common.MapStr{"ok": float64(1)},
+	}
+	event := txns.onMessage(tuple, reply, 10)
+	if event == nil {
+		t.Fatal("expected a merged transaction event")
+	}
+	if event["auth_result"] != "success" {
+		t.Errorf(`event["auth_result"] = %v, want "success"`, event["auth_result"])
+	}
+	if event["mechanism"] != "SCRAM-SHA-256" {
+		t.Errorf(`event["mechanism"] = %v, want "SCRAM-SHA-256"`, event["mechanism"])
+	}
+}
+
+func TestTransactionsSurfacesErrmsgAsError(t *testing.T) {
+	txns := newTransactions(defaultTransactionTimeout)
+	tuple := common.TcpTuple{}
+
+	request := &MongodbMessage{
+		ExpectsResponse: true,
+		requestId:       5,
+		method:          "find",
+		event:           common.MapStr{"fullCollectionName": "test.$cmd", "query": `{"find":"test"}`},
+	}
+	txns.onMessage(tuple, request, 10)
+
+	replyDoc := bson.M{"ok": float64(0), "code": int32(13), "errmsg": "not authorized"}
+	reply := &MongodbMessage{IsResponse: true, responseTo: 5, event: common.MapStr{}}
+	recordCommandResult(replyDoc, reply)
+
+	event := txns.onMessage(tuple, reply, 10)
+	if event == nil {
+		t.Fatal("expected a merged transaction event")
+	}
+	if event["error"] != "not authorized" {
+		t.Errorf(`event["error"] = %v, want "not authorized"`, event["error"])
+	}
+}
+
+func TestTransactionsIgnoresExhaustContinuation(t *testing.T) {
+	txns := newTransactions(defaultTransactionTimeout)
+	tuple := common.TcpTuple{}
+
+	request := &MongodbMessage{
+		ExpectsResponse: true,
+		requestId:       1,
+		method:          "find",
+		event:           common.MapStr{"fullCollectionName": "test.$cmd", "query": `{"find":"test"}`},
+	}
+	txns.onMessage(tuple, request, 50)
+
+	firstReply := &MongodbMessage{
+		IsResponse: true,
+		responseTo: 1,
+		moreToCome: true,
+		event:      common.MapStr{"numberReturned": 3, "cursorId": 7},
+	}
+	if event := txns.onMessage(tuple, firstReply, 100); event == nil {
+		t.Fatal("expected a merged transaction event for the first reply")
+	}
+
+	// the server keeps pushing exhaust continuations with responseTo == 0
+	// and no corresponding client request, until the last one clears
+	// moreToCome
+	continuation := &MongodbMessage{
+		IsResponse:      false,
+		ExpectsResponse: false,
+		responseTo:      0,
+		requestId:       2,
+		moreToCome:      true,
+		event:           common.MapStr{"numberReturned": 3, "cursorId": 7},
+	}
+	if event := txns.onMessage(tuple, continuation, 100); event != nil {
+		t.Fatalf("expected no event for an exhaust continuation, got %v", event)
+	}
+
+	// the final continuation is the one real bug case: moreToCome is
+	// clear, so classification (responseTo == 0 -> ExpectsResponse) never
+	// gets corrected away from "fresh request" the way earlier
+	// continuations do
+	final := &MongodbMessage{
+		IsResponse:      false,
+		ExpectsResponse: true,
+		responseTo:      0,
+		requestId:       3,
+		moreToCome:      false,
+		event:           common.MapStr{"numberReturned": 0, "cursorId": 0},
+	}
+	if event := txns.onMessage(tuple, final, 100); event != nil {
+		t.Fatalf("expected no event for the final exhaust continuation, got %v", event)
+	}
+
+	if len(txns.pending) != 0 {
+		t.Errorf("pending = %v, want empty: exhaust continuation leaked in as a phantom request", txns.pending)
+	}
+	if len(txns.exhaustCursors) != 0 {
+		t.Errorf("exhaustCursors = %v, want empty after the stream ended", txns.exhaustCursors)
+	}
+}
+
+// TestTransactionsExpiresAbandonedExhaustCursor reproduces a stream that
+// drops mid-exhaust and never sends the final continuation that would
+// otherwise have cleared the exhaustCursors marker: expire() must reclaim
+// it anyway instead of leaking it forever.
+func TestTransactionsExpiresAbandonedExhaustCursor(t *testing.T) {
+	txns := newTransactions(time.Millisecond)
+	tuple := common.TcpTuple{}
+
+	reply := &MongodbMessage{
+		IsResponse: true,
+		responseTo: 1,
+		moreToCome: true,
+		event:      common.MapStr{},
+	}
+	txns.pending[transactionKey{tuple.Hashable(), 1}] = &transaction{ts: time.Now(), request: &MongodbMessage{}}
+	txns.onMessage(tuple, reply, 10)
+
+	if len(txns.exhaustCursors) != 1 {
+		t.Fatalf("exhaustCursors = %v, want exactly one in-flight entry", txns.exhaustCursors)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	txns.onMessage(tuple, &MongodbMessage{IsResponse: true, responseTo: 999, event: common.MapStr{}}, 0)
+
+	if len(txns.exhaustCursors) != 0 {
+		t.Errorf("exhaustCursors = %v, want empty after timeout", txns.exhaustCursors)
+	}
+}
+
+func TestTransactionsIgnoresUnmatchedReply(t *testing.T) {
+	txns := newTransactions(defaultTransactionTimeout)
+	tuple := common.TcpTuple{}
+
+	reply := &MongodbMessage{
+		IsResponse: true,
+		responseTo: 99,
+		event:      common.MapStr{},
+	}
+	if event := txns.onMessage(tuple, reply, 10); event != nil {
+		t.Fatalf("expected no event for a reply with no matching request, got %v", event)
+	}
+}